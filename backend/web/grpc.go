@@ -0,0 +1,73 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"sync"
+
+	"github.com/coreos/etcdlabs/cluster"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3client"
+	"github.com/coreos/etcd/etcdserver/api/v3election"
+	"github.com/coreos/etcd/etcdserver/api/v3election/v3electionpb"
+	"github.com/coreos/etcd/etcdserver/api/v3lock"
+	"github.com/coreos/etcd/etcdserver/api/v3lock/v3lockpb"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc"
+	"google.golang.org/grpc"
+)
+
+var (
+	embeddedClientMu sync.Mutex
+	embeddedClient   *clientv3.Client
+)
+
+// embeddedClusterClient returns a clientv3.Client that talks to globalCluster
+// in-process via v3client, memoized for the lifetime of the current cluster.
+// web.Server.Stop resets it so a restarted cluster gets a fresh client bound
+// to the new embedded server.
+func embeddedClusterClient(c *cluster.Cluster) *clientv3.Client {
+	embeddedClientMu.Lock()
+	defer embeddedClientMu.Unlock()
+	if embeddedClient == nil {
+		embeddedClient = v3client.New(c.Server())
+	}
+	return embeddedClient
+}
+
+func resetEmbeddedClusterClient() {
+	embeddedClientMu.Lock()
+	embeddedClient = nil
+	embeddedClientMu.Unlock()
+}
+
+// newGRPCServer builds an in-process gRPC server bound to c. v3rpc.Server
+// does the same thing etcd embed's own client port setup does: it builds a
+// *grpc.Server with KV/Watch/Lease/Cluster/Maintenance registered directly
+// against the embedded etcdserver.Server, so Range/DeleteRange/Txn and the
+// rest of the real server interfaces are satisfied without going through a
+// clientv3.Client (which implements a different, friendlier set of method
+// signatures and can't be registered as a server itself).
+//
+// v3lock and v3election are, by contrast, built on top of a clientv3.Client,
+// so they're registered afterward using embeddedClusterClient.
+func newGRPCServer(c *cluster.Cluster) *grpc.Server {
+	s := v3rpc.Server(c.Server(), nil)
+
+	client := embeddedClusterClient(c)
+	v3lockpb.RegisterLockServer(s, v3lock.NewLockServer(client))
+	v3electionpb.RegisterElectionServer(s, v3election.NewElectionServer(client))
+	return s
+}
@@ -0,0 +1,288 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcdlabs/pkg/ratelimit"
+
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/golang/glog"
+)
+
+// lockSessionTTL bounds how long a demo lock/election lease can live
+// without being refreshed, so an abandoned browser tab doesn't pin a lock
+// or an election seat forever.
+const lockSessionTTL = 30 // seconds
+
+// lockRequestTimeout bounds how long a single Lock/Campaign call blocks
+// waiting on contention before giving the caller a clear error instead of
+// hanging the request indefinitely.
+const lockRequestTimeout = 5 * time.Second
+
+// lockSessionIdleTimeout bounds how long a visitor's lock session and
+// limiter are kept after their last use before sweepIdleLockSessions
+// reclaims them, the same TTL-sweep approach perIPLimiter's sweepIdle uses
+// in middleware.go, so a long-lived instance doesn't accumulate one
+// concurrency.Session and limiter per visitor forever.
+const lockSessionIdleTimeout = 10 * time.Minute
+
+var (
+	lockSessionsMu sync.Mutex
+	lockSessions   = make(map[string]*concurrency.Session)
+	lockLimiters   = make(map[string]ratelimit.RequestLimiter)
+	lockLastUsed   = make(map[string]time.Time)
+
+	electionsMu sync.Mutex
+	elections   = make(map[string]*concurrency.Election)
+)
+
+// getOrCreateLockSession returns the concurrency.Session for a browser
+// session id, creating one bound to the embedded cluster client if needed.
+// Sessions are per-id rather than global so one visitor's lock doesn't
+// block another's demo.
+func getOrCreateLockSession(id string) (*concurrency.Session, error) {
+	lockSessionsMu.Lock()
+	defer lockSessionsMu.Unlock()
+	lockLastUsed[id] = time.Now()
+
+	if s, ok := lockSessions[id]; ok {
+		select {
+		case <-s.Done():
+			delete(lockSessions, id)
+		default:
+			return s, nil
+		}
+	}
+
+	s, err := concurrency.NewSession(embeddedClusterClient(globalCluster), concurrency.WithTTL(lockSessionTTL))
+	if err != nil {
+		return nil, err
+	}
+	lockSessions[id] = s
+	return s, nil
+}
+
+// lockLimiterFor allows one request every globalStopRestartIntervalLimit,
+// keyed per session instead of applied globally, so one session's
+// Lock/Campaign churn can't starve everyone else's.
+func lockLimiterFor(rootCtx context.Context, id string) ratelimit.RequestLimiter {
+	lockSessionsMu.Lock()
+	defer lockSessionsMu.Unlock()
+	lockLastUsed[id] = time.Now()
+	l, ok := lockLimiters[id]
+	if !ok {
+		l = ratelimit.NewRequestLimiter(rootCtx, globalStopRestartIntervalLimit)
+		lockLimiters[id] = l
+	}
+	return l
+}
+
+// sweepIdleLockSessions closes and forgets every lock/election session and
+// limiter whose id hasn't been used in lockSessionIdleTimeout.
+func sweepIdleLockSessions() {
+	cutoff := time.Now().Add(-lockSessionIdleTimeout)
+
+	lockSessionsMu.Lock()
+	defer lockSessionsMu.Unlock()
+	for id, last := range lockLastUsed {
+		if last.After(cutoff) {
+			continue
+		}
+		if s, ok := lockSessions[id]; ok {
+			if err := s.Close(); err != nil {
+				glog.Warningf("failed to close idle lock session %q (%v)", id, err)
+			}
+			delete(lockSessions, id)
+		}
+		delete(lockLimiters, id)
+		delete(lockLastUsed, id)
+	}
+}
+
+// sweepLockSessionsLoop runs sweepIdleLockSessions on a fraction of
+// lockSessionIdleTimeout until stopc is closed.
+func sweepLockSessionsLoop(stopc <-chan struct{}) {
+	ticker := time.NewTicker(lockSessionIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopc:
+			return
+		case <-ticker.C:
+			sweepIdleLockSessions()
+		}
+	}
+}
+
+// closeLockSessions tears down every outstanding lock/election session and
+// its lease. It is called from Server.Stop before the cluster shuts down so
+// leases don't outlive rootCtx being canceled.
+func closeLockSessions() {
+	electionsMu.Lock()
+	for k := range elections {
+		delete(elections, k)
+	}
+	electionsMu.Unlock()
+
+	lockSessionsMu.Lock()
+	defer lockSessionsMu.Unlock()
+	for id, s := range lockSessions {
+		if err := s.Close(); err != nil {
+			glog.Warningf("failed to close lock session %q (%v)", id, err)
+		}
+		delete(lockSessions, id)
+	}
+	lockLimiters = make(map[string]ratelimit.RequestLimiter)
+	lockLastUsed = make(map[string]time.Time)
+}
+
+type lockResponse struct {
+	Locked bool   `json:"locked"`
+	Error  string `json:"error,omitempty"`
+}
+
+// clientLockRequest is the body of a POST to /client-lock.
+type clientLockRequest struct {
+	SessionID string `json:"session_id"`
+	Key       string `json:"key"`
+	Unlock    bool   `json:"unlock"`
+}
+
+// clientLockHandler demonstrates v3lock's Lock/Unlock against the embedded
+// cluster so playground users can see a distributed lock in action without
+// running etcdctl themselves.
+func clientLockHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	var creq clientLockRequest
+	if err := json.NewDecoder(req.Body).Decode(&creq); err != nil {
+		return writeLockResponse(w, http.StatusBadRequest, lockResponse{Error: err.Error()})
+	}
+	if creq.SessionID == "" {
+		return writeLockResponse(w, http.StatusBadRequest, lockResponse{Error: "session_id is required"})
+	}
+
+	if !lockLimiterFor(ctx, creq.SessionID).Allow() {
+		return writeLockResponse(w, http.StatusTooManyRequests, lockResponse{Error: "rate limit exceeded; slow down"})
+	}
+
+	session, err := getOrCreateLockSession(creq.SessionID)
+	if err != nil {
+		return writeLockResponse(w, http.StatusInternalServerError, lockResponse{Error: err.Error()})
+	}
+
+	lctx, cancel := context.WithTimeout(ctx, lockRequestTimeout)
+	defer cancel()
+
+	mu := concurrency.NewMutex(session, creq.Key)
+	if creq.Unlock {
+		// mu has not locked anything, so mu.Unlock would delete an empty
+		// key; delete the key Lock creates for this session instead.
+		lockKey := fmt.Sprintf("%s/%x", creq.Key, session.Lease())
+		if _, err := session.Client().Delete(lctx, lockKey); err != nil {
+			return writeLockResponse(w, http.StatusInternalServerError, lockResponse{Error: err.Error()})
+		}
+		return writeLockResponse(w, http.StatusOK, lockResponse{Locked: false})
+	}
+
+	if err := mu.Lock(lctx); err != nil {
+		return writeLockResponse(w, http.StatusInternalServerError, lockResponse{Error: err.Error()})
+	}
+	return writeLockResponse(w, http.StatusOK, lockResponse{Locked: true})
+}
+
+func writeLockResponse(w http.ResponseWriter, status int, resp lockResponse) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(resp)
+}
+
+type electionResponse struct {
+	Leader bool   `json:"leader"`
+	Error  string `json:"error,omitempty"`
+}
+
+// clientElectionRequest is the body of a POST to /client-election.
+type clientElectionRequest struct {
+	SessionID string `json:"session_id"`
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+	Resign    bool   `json:"resign"`
+}
+
+// clientElectionHandler demonstrates v3election's Campaign/Resign against
+// the embedded cluster, the other half of the etcd concurrency primitives
+// this playground lets users try out.
+func clientElectionHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	var creq clientElectionRequest
+	if err := json.NewDecoder(req.Body).Decode(&creq); err != nil {
+		return writeElectionResponse(w, http.StatusBadRequest, electionResponse{Error: err.Error()})
+	}
+	if creq.SessionID == "" || creq.Name == "" {
+		return writeElectionResponse(w, http.StatusBadRequest, electionResponse{Error: "session_id and name are required"})
+	}
+
+	if !lockLimiterFor(ctx, creq.SessionID).Allow() {
+		return writeElectionResponse(w, http.StatusTooManyRequests, electionResponse{Error: "rate limit exceeded; slow down"})
+	}
+
+	session, err := getOrCreateLockSession(creq.SessionID)
+	if err != nil {
+		return writeElectionResponse(w, http.StatusInternalServerError, electionResponse{Error: err.Error()})
+	}
+
+	key := creq.SessionID + "/" + creq.Name
+
+	if creq.Resign {
+		electionsMu.Lock()
+		e, ok := elections[key]
+		delete(elections, key)
+		electionsMu.Unlock()
+		if !ok {
+			return writeElectionResponse(w, http.StatusOK, electionResponse{Leader: false})
+		}
+
+		ectx, cancel := context.WithTimeout(ctx, lockRequestTimeout)
+		defer cancel()
+		if err := e.Resign(ectx); err != nil {
+			return writeElectionResponse(w, http.StatusInternalServerError, electionResponse{Error: err.Error()})
+		}
+		return writeElectionResponse(w, http.StatusOK, electionResponse{Leader: false})
+	}
+
+	e := concurrency.NewElection(session, creq.Name)
+	ectx, cancel := context.WithTimeout(ctx, lockRequestTimeout)
+	defer cancel()
+	if err := e.Campaign(ectx, creq.Value); err != nil {
+		return writeElectionResponse(w, http.StatusInternalServerError, electionResponse{Error: err.Error()})
+	}
+
+	electionsMu.Lock()
+	elections[key] = e
+	electionsMu.Unlock()
+
+	return writeElectionResponse(w, http.StatusOK, electionResponse{Leader: true})
+}
+
+func writeElectionResponse(w http.ResponseWriter, status int, resp electionResponse) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(resp)
+}
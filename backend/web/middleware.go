@@ -0,0 +1,237 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// RateLimitConfig configures the per-client-IP token bucket and concurrency
+// cap applied to every route, in place of a single limiter shared by every
+// caller.
+type RateLimitConfig struct {
+	// PerIPRate is the sustained token-bucket refill rate per client IP.
+	PerIPRate rate.Limit
+	// PerIPBurst is the token-bucket burst size per client IP.
+	PerIPBurst int
+	// PerIPConcurrency caps in-flight requests per client IP.
+	PerIPConcurrency int
+	// TrustedProxies lists IPs/CIDRs allowed to set X-Real-IP or
+	// X-Forwarded-For; requests from anyone else have those headers
+	// ignored so a client can't spoof its way into someone else's bucket.
+	TrustedProxies []string
+	// IdleTimeout bounds how long an IP's state is kept after its last
+	// request before sweepIdle reclaims it. Zero uses
+	// defaultRateLimitIdleTimeout.
+	IdleTimeout time.Duration
+}
+
+// defaultRateLimitIdleTimeout is how long a per-IP limiter entry survives
+// after its last request before it is swept, so a public instance doesn't
+// grow one entry per distinct caller for the life of the process.
+const defaultRateLimitIdleTimeout = 10 * time.Minute
+
+// DefaultRateLimitConfig scopes rate limiting per IP with a modest sustained
+// rate and a small concurrency cap.
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		PerIPRate:        rate.Every(2 * time.Second),
+		PerIPBurst:       1,
+		PerIPConcurrency: 4,
+		IdleTimeout:      defaultRateLimitIdleTimeout,
+	}
+}
+
+var (
+	rateLimitAccepted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "etcdlabs",
+		Subsystem: "ratelimit",
+		Name:      "accepted_total",
+		Help:      "Requests accepted by the per-IP rate limiter, by route.",
+	}, []string{"route"})
+	rateLimitRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "etcdlabs",
+		Subsystem: "ratelimit",
+		Name:      "rejected_total",
+		Help:      "Requests rejected by the per-IP rate limiter, by route.",
+	}, []string{"route"})
+	rateLimitQueued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "etcdlabs",
+		Subsystem: "ratelimit",
+		Name:      "queued_total",
+		Help:      "Requests that had to wait for an in-flight concurrency slot, by route.",
+	}, []string{"route"})
+)
+
+func init() {
+	prometheus.MustRegister(rateLimitAccepted, rateLimitRejected, rateLimitQueued)
+}
+
+// ipState is one client IP's token bucket plus its in-flight semaphore.
+type ipState struct {
+	limiter  *rate.Limiter
+	inflight chan struct{}
+
+	lastUsed time.Time
+}
+
+// perIPLimiter enforces a token-bucket rate and an in-flight concurrency
+// cap per client IP, layered onto every ContextAdapter in place of the
+// single global limiter every route used to share. sweepIdle reclaims
+// entries for IPs that haven't made a request in cfg.IdleTimeout, so state
+// doesn't grow without bound over the life of the process.
+type perIPLimiter struct {
+	cfg RateLimitConfig
+
+	mu    sync.Mutex
+	state map[string]*ipState
+}
+
+func newPerIPLimiter(cfg RateLimitConfig) *perIPLimiter {
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = defaultRateLimitIdleTimeout
+	}
+	return &perIPLimiter{cfg: cfg, state: make(map[string]*ipState)}
+}
+
+func (l *perIPLimiter) stateFor(ip string) *ipState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.state[ip]
+	if !ok {
+		s = &ipState{
+			limiter:  rate.NewLimiter(l.cfg.PerIPRate, l.cfg.PerIPBurst),
+			inflight: make(chan struct{}, l.cfg.PerIPConcurrency),
+		}
+		l.state[ip] = s
+	}
+	s.lastUsed = time.Now()
+	return s
+}
+
+// sweepIdle removes state for any IP whose lastUsed is older than
+// l.cfg.IdleTimeout.
+func (l *perIPLimiter) sweepIdle() {
+	cutoff := time.Now().Add(-l.cfg.IdleTimeout)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, s := range l.state {
+		if s.lastUsed.Before(cutoff) {
+			delete(l.state, ip)
+		}
+	}
+}
+
+// sweepLoop runs sweepIdle on a fraction of l.cfg.IdleTimeout until stopc is
+// closed.
+func (l *perIPLimiter) sweepLoop(stopc <-chan struct{}) {
+	ticker := time.NewTicker(l.cfg.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopc:
+			return
+		case <-ticker.C:
+			l.sweepIdle()
+		}
+	}
+}
+
+// middleware wraps h with the per-IP rate limit and concurrency cap for
+// route, rejecting with 503 and Retry-After once the bucket is empty, and
+// queuing (rather than rejecting) when only the concurrency cap is hit.
+func (l *perIPLimiter) middleware(route string, h ContextHandler) ContextHandler {
+	return ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+		ip := clientIP(req, l.cfg.TrustedProxies)
+		s := l.stateFor(ip)
+
+		if !s.limiter.Allow() {
+			rateLimitRejected.WithLabelValues(route).Inc()
+			r := s.limiter.Reserve()
+			retryAfter := r.Delay()
+			r.Cancel()
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds()+1)))
+			http.Error(w, "rate limit exceeded; slow down", http.StatusServiceUnavailable)
+			return nil
+		}
+
+		select {
+		case s.inflight <- struct{}{}:
+		default:
+			rateLimitQueued.WithLabelValues(route).Inc()
+			select {
+			case s.inflight <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		defer func() { <-s.inflight }()
+
+		rateLimitAccepted.WithLabelValues(route).Inc()
+		return h.ServeHTTPContext(ctx, w, req)
+	})
+}
+
+// clientIP extracts the caller's address from req.RemoteAddr, honoring
+// X-Real-IP/X-Forwarded-For only when the immediate peer is a trusted
+// proxy. This mirrors the pattern Gitaly's limithandler uses to avoid a
+// client spoofing its way into a different IP's bucket.
+func clientIP(req *http.Request, trustedProxies []string) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	if !isTrustedProxy(host, trustedProxies) {
+		return host
+	}
+
+	if v := req.Header.Get("X-Real-IP"); v != "" {
+		return v
+	}
+	if v := req.Header.Get("X-Forwarded-For"); v != "" {
+		parts := strings.Split(v, ",")
+		return strings.TrimSpace(parts[0])
+	}
+	return host
+}
+
+func isTrustedProxy(host string, trustedProxies []string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, entry := range trustedProxies {
+		if _, block, err := net.ParseCIDR(entry); err == nil {
+			if block.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if entry == host {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcdlabs/pkg/record/backend"
+	"github.com/coreos/etcdlabs/pkg/record/recordpb"
+
+	"github.com/golang/glog"
+)
+
+var (
+	latestRecordKeysMu sync.Mutex
+	// latestRecordKeys maps a tester endpoint to the key its most recent
+	// snapshot was saved under, so getRecordRequestHandler knows what to
+	// pass to Backend.Load without listing the whole backend.
+	latestRecordKeys = make(map[string]string)
+)
+
+// syncRecordBackend periodically persists rec to b on the same cadence as
+// globalSyncRecordIntervalLimit, replacing the GCS-only sync loop with one
+// that works against any record.Backend chosen by StartServer's Config.
+// Each endpoint's data is saved under its own "<endpoint>/<unix-nano>" key
+// rather than one static key, so Backend implementations that cache by key
+// (see pkg/record/backend's cache) keep a snapshot per endpoint instead of
+// only ever overwriting a single entry. Every tick also wakes /ws/record
+// subscribers directly when the in-memory record has changed since the last
+// push, whether or not the saves succeeded, instead of leaving that to a
+// separately ticking poller.
+func syncRecordBackend(ctx context.Context, b backend.Backend, rec *recordpb.Record, stopc <-chan struct{}) {
+	ticker := time.NewTicker(globalSyncRecordIntervalLimit)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopc:
+			return
+		case <-ticker.C:
+			globalRecordMu.RLock()
+			testData := make([]*recordpb.Data, len(rec.TestData))
+			copy(testData, rec.TestData)
+			encoded, jerr := json.Marshal(rec)
+			globalRecordMu.RUnlock()
+
+			now := time.Now()
+			for _, d := range testData {
+				key := fmt.Sprintf("%s/%d", d.Endpoint, now.UnixNano())
+				if err := b.Save(ctx, key, &recordpb.Record{TestData: []*recordpb.Data{d}}); err != nil {
+					glog.Warningf("failed to sync record for %q to %s backend (%v)", d.Endpoint, b.Name(), err)
+					continue
+				}
+				latestRecordKeysMu.Lock()
+				latestRecordKeys[d.Endpoint] = key
+				latestRecordKeysMu.Unlock()
+			}
+
+			if jerr != nil {
+				glog.Warningf("failed to marshal record (%v)", jerr)
+				continue
+			}
+			globalRecordBroadcaster.notify(string(encoded))
+		}
+	}
+}
+
+// loadLatestRecord merges the most recently saved snapshot for every
+// endpoint tracked in latestRecordKeys into a single Record, reading each
+// one through b.
+func loadLatestRecord(ctx context.Context, b backend.Backend) (*recordpb.Record, error) {
+	latestRecordKeysMu.Lock()
+	keys := make([]string, 0, len(latestRecordKeys))
+	for _, key := range latestRecordKeys {
+		keys = append(keys, key)
+	}
+	latestRecordKeysMu.Unlock()
+
+	merged := &recordpb.Record{TestData: make([]*recordpb.Data, 0, len(keys))}
+	for _, key := range keys {
+		rec, err := b.Load(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		merged.TestData = append(merged.TestData, rec.TestData...)
+	}
+	return merged, nil
+}
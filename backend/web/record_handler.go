@@ -0,0 +1,92 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/coreos/etcdlabs/pkg/record/backend"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// getRecordRequestHandler serves the latest recorded snapshot for every
+// tester endpoint. When a record.Backend is configured it reads through
+// loadLatestRecord, which only knows the keys this process has saved, so
+// snapshots an earlier process wrote are not read and the response holds
+// no test data until the first sync. Without a backend, or when a load
+// fails, it falls back to the in-memory globalRecord.
+func getRecordRequestHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	globalRecordBackendMu.RLock()
+	rb := globalRecordBackend
+	globalRecordBackendMu.RUnlock()
+
+	if rb != nil {
+		merged, err := loadLatestRecord(ctx, rb)
+		if err != nil {
+			glog.Warningf("failed to load record from backend (%v)", err)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			return json.NewEncoder(w).Encode(merged)
+		}
+	}
+
+	globalRecordMu.RLock()
+	defer globalRecordMu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(globalRecord)
+}
+
+var (
+	recordCacheHits = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "etcdlabs",
+		Subsystem: "record",
+		Name:      "cache_hits",
+		Help:      "Cumulative record cache hits reported by the configured record.Backend, if it implements backend.Stater.",
+	}, func() float64 {
+		hits, _ := recordBackendStats()
+		return float64(hits)
+	})
+	recordCacheMisses = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "etcdlabs",
+		Subsystem: "record",
+		Name:      "cache_misses",
+		Help:      "Cumulative record cache misses reported by the configured record.Backend, if it implements backend.Stater.",
+	}, func() float64 {
+		_, misses := recordBackendStats()
+		return float64(misses)
+	})
+)
+
+func init() {
+	prometheus.MustRegister(recordCacheHits, recordCacheMisses)
+}
+
+// recordBackendStats returns the hit/miss counts from globalRecordBackend
+// if it implements backend.Stater, or zeros if no backend is configured or
+// it doesn't track stats.
+func recordBackendStats() (hits, misses uint64) {
+	globalRecordBackendMu.RLock()
+	rb := globalRecordBackend
+	globalRecordBackendMu.RUnlock()
+
+	if s, ok := rb.(backend.Stater); ok {
+		return s.Stats()
+	}
+	return 0, 0
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -25,12 +26,12 @@ import (
 	"time"
 
 	"github.com/coreos/etcdlabs/cluster"
-	"github.com/coreos/etcdlabs/pkg/gcp"
-	"github.com/coreos/etcdlabs/pkg/ratelimit"
+	"github.com/coreos/etcdlabs/pkg/record/backend"
 	"github.com/coreos/etcdlabs/pkg/record/recordpb"
 
-	"cloud.google.com/go/storage"
 	"github.com/golang/glog"
+	"github.com/soheilhy/cmux"
+	"google.golang.org/grpc"
 )
 
 var (
@@ -62,11 +63,20 @@ func startCluster(rootCtx context.Context, rootCancel func()) (*cluster.Cluster,
 	return cluster.Start(cfg)
 }
 
+// DefaultShutdownTimeout bounds how long Stop waits for in-flight REST
+// requests and gRPC calls to drain before forcing them closed. WebSocket
+// streams are not waited for; they end once rootCtx is canceled.
+const DefaultShutdownTimeout = 5 * time.Second
+
 // Server warps http.Server.
 type Server struct {
-	mu         sync.RWMutex
-	addrURL    url.URL
-	httpServer *http.Server
+	mu              sync.RWMutex
+	addrURL         url.URL
+	ln              net.Listener
+	cm              cmux.CMux
+	httpServer      *http.Server
+	grpcServer      *grpc.Server
+	shutdownTimeout time.Duration
 
 	rootCancel func()
 	stopc      chan struct{}
@@ -76,27 +86,62 @@ type Server struct {
 var (
 	globalWebserverPort int
 
-	globalCluster *cluster.Cluster
+	// globalWebserverWSFrameBytes bounds the size of a single WebSocket
+	// frame for the streaming endpoints below, and globalWSUpgrader is
+	// built from it. Both start out at the package default so other code
+	// in this package can reference them before StartServer runs, but
+	// StartServer always rebuilds them from its wsFrameBytes argument.
+	globalWebserverWSFrameBytes = defaultWebsocketFrameBytes
+	globalWSUpgrader            = newWebsocketUpgrader(defaultWebsocketFrameBytes)
 
-	globalClientRequestIntervalLimit = 3 * time.Second
-	globalClientRequestLimiter       ratelimit.RequestLimiter
+	globalCluster *cluster.Cluster
 
+	// globalStopRestartIntervalLimit and globalSyncRecordIntervalLimit
+	// remain as plain cadences used by the lock/election session limiter
+	// and the record sync loop; per-request rate limiting itself now
+	// lives in globalRateLimiter below instead of a package-level
+	// ratelimit.RequestLimiter per route.
 	globalStopRestartIntervalLimit = 5 * time.Second
-	globalStopRestartLimiter       ratelimit.RequestLimiter
+	globalSyncRecordIntervalLimit  = 30 * time.Second
 
-	globalSyncRecordIntervalLimit = 30 * time.Second
-	globalSyncRecordLimiter       ratelimit.RequestLimiter
+	// globalRateLimiter enforces a token bucket and concurrency cap per
+	// client IP, replacing the three global limiters that used to let one
+	// abusive client starve every other user. It is (re)built in
+	// StartServer from the caller's RateLimitConfig.
+	globalRateLimiter *perIPLimiter
 
 	globalRecordMu      sync.RWMutex
 	globalRecordEnabled bool
 	globalRecord        = &recordpb.Record{
 		TestData: []*recordpb.Data{},
 	}
+
+	// globalRecordBackendMu guards globalRecordBackend, which
+	// getRecordRequestHandler reads through for historical snapshots and
+	// which recordBackendStats reads for cache hit/miss counts.
+	globalRecordBackendMu sync.RWMutex
+	globalRecordBackend   backend.Backend
 )
 
-// StartServer starts a backend webserver with stoppable listener.
-func StartServer(port int, key []byte, recordTesterEps []string) (*Server, error) {
+// StartServer starts a backend webserver with stoppable listener. recordCfg
+// selects and configures the record.Backend (GCS, S3, or local disk) that
+// recorded test data is synced to. rateLimitCfg configures the per-client-IP
+// rate limit and concurrency cap applied to every route. shutdownTimeout
+// bounds how long Stop waits for in-flight REST requests and gRPC calls to drain;
+// a zero value uses DefaultShutdownTimeout. wsFrameBytes bounds the size of
+// a single /ws/cluster-status or /ws/record frame; a zero value uses
+// defaultWebsocketFrameBytes.
+func StartServer(port int, recordCfg backend.Config, rateLimitCfg RateLimitConfig, shutdownTimeout time.Duration, wsFrameBytes int, recordTesterEps []string) (*Server, error) {
 	globalWebserverPort = port
+	globalRateLimiter = newPerIPLimiter(rateLimitCfg)
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = DefaultShutdownTimeout
+	}
+	if wsFrameBytes <= 0 {
+		wsFrameBytes = defaultWebsocketFrameBytes
+	}
+	globalWebserverWSFrameBytes = wsFrameBytes
+	globalWSUpgrader = newWebsocketUpgrader(wsFrameBytes)
 
 	glog.Infof("tester endpoints %+v", recordTesterEps)
 	for _, ep := range recordTesterEps {
@@ -112,42 +157,70 @@ func StartServer(port int, key []byte, recordTesterEps []string) (*Server, error
 	}
 	globalCluster = c
 
-	// allow only 1 request for every 2 second
-	globalClientRequestLimiter = ratelimit.NewRequestLimiter(rootCtx, globalClientRequestIntervalLimit)
-
-	// rate-limit more strictly for every 3 second
-	globalStopRestartLimiter = ratelimit.NewRequestLimiter(rootCtx, globalStopRestartIntervalLimit)
-
-	// rate-limit fetch record for every 30 second
-	globalSyncRecordLimiter = ratelimit.NewRequestLimiter(rootCtx, globalSyncRecordIntervalLimit)
-
 	mux := http.NewServeMux()
 	mux.Handle("/conn", &ContextAdapter{
 		ctx:     rootCtx,
-		handler: withCache(ContextHandlerFunc(connectHandler)),
+		handler: globalRateLimiter.middleware("/conn", withCache(ContextHandlerFunc(connectHandler))),
 	})
 	mux.Handle("/server-status", &ContextAdapter{
 		ctx:     rootCtx,
-		handler: withCache(ContextHandlerFunc(serverStatusHandler)),
+		handler: globalRateLimiter.middleware("/server-status", withCache(ContextHandlerFunc(serverStatusHandler))),
 	})
 	mux.Handle("/client-request", &ContextAdapter{
 		ctx:     rootCtx,
-		handler: withCache(ContextHandlerFunc(clientRequestHandler)),
+		handler: globalRateLimiter.middleware("/client-request", withCache(ContextHandlerFunc(clientRequestHandler))),
 	})
 	mux.Handle("/get-record", &ContextAdapter{
 		ctx:     rootCtx,
-		handler: withCache(ContextHandlerFunc(getRecordRequestHandler)),
+		handler: globalRateLimiter.middleware("/get-record", withCache(ContextHandlerFunc(getRecordRequestHandler))),
+	})
+	mux.Handle("/ws/cluster-status", &ContextAdapter{
+		ctx:     rootCtx,
+		handler: globalRateLimiter.middleware("/ws/cluster-status", ContextHandlerFunc(clusterStatusStreamHandler)),
+	})
+	mux.Handle("/ws/record", &ContextAdapter{
+		ctx:     rootCtx,
+		handler: globalRateLimiter.middleware("/ws/record", ContextHandlerFunc(recordStreamHandler)),
+	})
+	mux.Handle("/client-lock", &ContextAdapter{
+		ctx:     rootCtx,
+		handler: globalRateLimiter.middleware("/client-lock", withCache(ContextHandlerFunc(clientLockHandler))),
+	})
+	mux.Handle("/client-election", &ContextAdapter{
+		ctx:     rootCtx,
+		handler: globalRateLimiter.middleware("/client-election", withCache(ContextHandlerFunc(clientElectionHandler))),
 	})
 
 	stopc := make(chan struct{})
 	addrURL := url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:%d", port)}
 	glog.Infof("started server %s", addrURL.String())
+
+	ln, err := net.Listen("tcp", addrURL.Host)
+	if err != nil {
+		rootCancel()
+		return nil, err
+	}
+
+	// cmux multiplexes gRPC (HTTP/2) and the REST/WebSocket handlers
+	// (HTTP/1.1) on the single listener so external etcd client libraries
+	// such as etcdctl and clientv3 can talk to the playground cluster on
+	// the same port the browser UI uses.
+	cm := cmux.New(ln)
+	grpcL := cm.Match(cmux.HTTP2HeaderField("content-type", "application/grpc"))
+	httpL := cm.Match(cmux.HTTP1Fast())
+
+	grpcServer := newGRPCServer(globalCluster)
+
 	srv := &Server{
-		addrURL:    addrURL,
-		httpServer: &http.Server{Addr: addrURL.Host, Handler: mux},
-		rootCancel: rootCancel,
-		stopc:      stopc,
-		donec:      make(chan struct{}),
+		addrURL:         addrURL,
+		ln:              ln,
+		cm:              cm,
+		httpServer:      &http.Server{Addr: addrURL.Host, Handler: mux},
+		grpcServer:      grpcServer,
+		shutdownTimeout: shutdownTimeout,
+		rootCancel:      rootCancel,
+		stopc:           stopc,
+		donec:           make(chan struct{}),
 	}
 
 	go func() {
@@ -160,21 +233,19 @@ func StartServer(port int, key []byte, recordTesterEps []string) (*Server, error
 			close(srv.donec)
 		}()
 
-		if len(key) > 0 {
-			glog.Infof("creating GCS client")
-			var api *gcp.GCS
-			api, err = gcp.NewGCS(context.Background(), "etcd", storage.ScopeFullControl, key, "record")
-			if err == nil {
-				globalRecordMu.Lock()
-				globalRecordEnabled = true
-				globalRecordMu.Unlock()
-				go func() { syncRecord(api, globalRecord, srv.stopc) }()
-			} else {
-				glog.Warning(err)
-			}
-			defer api.Close()
+		glog.Infof("creating %q record backend", recordCfg.Kind)
+		rb, err := backend.New(rootCtx, recordCfg)
+		if err == nil {
+			globalRecordMu.Lock()
+			globalRecordEnabled = true
+			globalRecordMu.Unlock()
+			globalRecordBackendMu.Lock()
+			globalRecordBackend = rb
+			globalRecordBackendMu.Unlock()
+			go func() { syncRecordBackend(rootCtx, rb, globalRecord, srv.stopc) }()
+			defer rb.Close()
 		} else {
-			glog.Infof("key not given; skip creating GCS client")
+			glog.Warning(err)
 			globalRecordMu.Lock()
 			globalRecordEnabled = false
 			globalRecordMu.Unlock()
@@ -182,8 +253,28 @@ func StartServer(port int, key []byte, recordTesterEps []string) (*Server, error
 
 		go func() { updateClusterStatus(srv.stopc) }()
 		go func() { cleanCache(srv.stopc) }()
-		if err := srv.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			glog.Fatal(err)
+		go func() { globalRateLimiter.sweepLoop(srv.stopc) }()
+		go func() { sweepLockSessionsLoop(srv.stopc) }()
+
+		go func() {
+			if err := srv.grpcServer.Serve(grpcL); err != nil && err != cmux.ErrListenerClosed && err != grpc.ErrServerStopped {
+				glog.Warningf("gRPC server exited (%v)", err)
+			}
+		}()
+		go func() {
+			if err := srv.httpServer.Serve(httpL); err != nil && err != http.ErrServerClosed && err != cmux.ErrListenerClosed {
+				glog.Warningf("HTTP server exited (%v)", err)
+			}
+		}()
+
+		if err := srv.cm.Serve(); err != nil && err != cmux.ErrListenerClosed {
+			// Stop closes stopc before closing ln, so an accept error after
+			// that is the expected shutdown path, not a fatal one.
+			select {
+			case <-srv.stopc:
+			default:
+				glog.Fatal(err)
+			}
 		}
 	}()
 	return srv, nil
@@ -194,22 +285,75 @@ func (srv *Server) StopNotify() <-chan struct{} {
 	return srv.stopc
 }
 
-// Stop stops the server. Useful for testing.
+// Stop gracefully stops the server, draining in-flight REST requests and
+// gRPC calls within srv.shutdownTimeout. Useful for testing.
 func (srv *Server) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), srv.shutdownTimeout)
+	defer cancel()
+	srv.StopWithContext(ctx)
+}
+
+// StopWithContext gracefully stops the server, draining in-flight
+// REST requests and gRPC calls until ctx is done, then shutting
+// down the embedded cluster. The sequencing mirrors etcd embed's staged
+// Close: close listeners, stop servers within their deadline, cancel the
+// serve context, close clients, then shut down the backend.
+func (srv *Server) StopWithContext(ctx context.Context) {
 	glog.Warningf("stopping server %s", srv.addrURL.String())
 	srv.mu.Lock()
 	if srv.httpServer == nil {
 		srv.mu.Unlock()
 		return
 	}
+
 	close(srv.stopc)
-	srv.httpServer.Close()
+
+	// close listeners: stop accepting new connections before draining
+	// the ones already in flight.
+	srv.ln.Close()
+
+	// stop servers with their per-timeout: a graceful httpServer.Shutdown
+	// drains in-flight REST requests but does not wait for hijacked
+	// WebSocket connections, whose handlers return once rootCtx is
+	// canceled below; grpcServer.GracefulStop drains in-flight gRPC calls.
+	// Both fall back to an abrupt close if
+	// ctx runs out first, rather than hanging Stop forever.
+	if err := srv.httpServer.Shutdown(ctx); err != nil {
+		glog.Warningf("HTTP server did not drain in time (%v); forcing close", err)
+		srv.httpServer.Close()
+	}
+
+	grpcStopped := make(chan struct{})
+	go func() {
+		srv.grpcServer.GracefulStop()
+		close(grpcStopped)
+	}()
+	select {
+	case <-grpcStopped:
+	case <-ctx.Done():
+		glog.Warning("gRPC server did not drain in time; forcing stop")
+		srv.grpcServer.Stop()
+		<-grpcStopped
+	}
+
+	// cancel serve contexts: rootCtx is canceled by the goroutine that
+	// started cm.Serve once it unwinds from the now-closed listener.
 	<-srv.donec
 	srv.mu.Unlock()
 	glog.Warningf("stopped server %s", srv.addrURL.String())
 
+	// close clients: tear down demo lock/election sessions so their
+	// leases don't outlive the cluster.
+	glog.Warning("stopping lock/election sessions")
+	closeLockSessions()
+	globalRecordBackendMu.Lock()
+	globalRecordBackend = nil
+	globalRecordBackendMu.Unlock()
+
+	// shutdown backend: finally stop the embedded cluster.
 	glog.Warning("stopping cluster")
 	globalCluster.Shutdown()
 	globalCluster = nil
+	resetEmbeddedClusterClient()
 	glog.Warning("stopped cluster")
 }
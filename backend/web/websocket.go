@@ -0,0 +1,196 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// clusterStatusPollInterval is how often updateClusterStatus checks
+// globalCluster for a change worth pushing. clusterStatusBroadcaster.notify
+// only wakes subscribers when the encoded snapshot actually differs from the
+// last one pushed, so a quiet cluster doesn't generate WebSocket traffic.
+const clusterStatusPollInterval = time.Second
+
+// defaultWebsocketFrameBytes is the fallback frame bound used until
+// StartServer sets globalWebserverWSFrameBytes from its caller's config.
+// gorilla/websocket's own default (64 KB) truncates a full 5-node cluster
+// snapshot with per-member leader/term/index detail.
+const defaultWebsocketFrameBytes = 10 * 1024 * 1024 // 10 MB
+
+// clusterStatusBroadcaster fans the latest cluster status out to any number
+// of connected WebSocket clients, only pushing a frame when the status
+// actually changes.
+type clusterStatusBroadcaster struct {
+	mu   sync.Mutex
+	subs map[chan struct{}]struct{}
+	last string
+}
+
+func newClusterStatusBroadcaster() *clusterStatusBroadcaster {
+	return &clusterStatusBroadcaster{subs: make(map[chan struct{}]struct{})}
+}
+
+func (b *clusterStatusBroadcaster) subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+	}
+}
+
+// notify wakes every subscriber if encoded differs from the last pushed
+// snapshot. Handlers re-read globalCluster themselves; this only carries the
+// "something changed" signal so every stream doesn't re-encode on its own
+// timer.
+func (b *clusterStatusBroadcaster) notify(encoded string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if encoded == b.last {
+		return
+	}
+	b.last = encoded
+	for ch := range b.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+var globalClusterStatusBroadcaster = newClusterStatusBroadcaster()
+
+var globalRecordBroadcaster = newClusterStatusBroadcaster()
+
+func newWebsocketUpgrader(frameBytes int) websocket.Upgrader {
+	return websocket.Upgrader{
+		ReadBufferSize:  frameBytes,
+		WriteBufferSize: frameBytes,
+		CheckOrigin:     func(r *http.Request) bool { return true },
+	}
+}
+
+// clusterStatusStreamHandler upgrades the connection to a WebSocket and
+// pushes a JSON frame of cluster state, member health, and leader changes
+// every time globalClusterStatusBroadcaster observes a change, rather than
+// making the UI poll /server-status and drop rate-limited responses.
+func clusterStatusStreamHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	conn, err := globalWSUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetReadLimit(int64(globalWebserverWSFrameBytes))
+
+	changed, unsub := globalClusterStatusBroadcaster.subscribe()
+	defer unsub()
+
+	// push the current status immediately so the client doesn't wait for
+	// the next change to render anything.
+	if err := writeClusterStatus(conn); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+			if err := writeClusterStatus(conn); err != nil {
+				glog.Warningf("cluster-status stream write error (%v)", err)
+				return err
+			}
+		}
+	}
+}
+
+func writeClusterStatus(conn *websocket.Conn) error {
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	return conn.WriteJSON(globalCluster)
+}
+
+// recordStreamHandler pushes globalRecord on connect and then whenever
+// syncRecordBackend's tick (every globalSyncRecordIntervalLimit) finds it
+// changed, so the UI doesn't re-fetch /get-record itself. Data is not pushed
+// between ticks, and with no record backend running only the first frame
+// is sent.
+func recordStreamHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	conn, err := globalWSUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetReadLimit(int64(globalWebserverWSFrameBytes))
+
+	changed, unsub := globalRecordBroadcaster.subscribe()
+	defer unsub()
+
+	if err := writeRecord(conn); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+			if err := writeRecord(conn); err != nil {
+				glog.Warningf("record stream write error (%v)", err)
+				return err
+			}
+		}
+	}
+}
+
+func writeRecord(conn *websocket.Conn) error {
+	globalRecordMu.RLock()
+	rec := globalRecord
+	globalRecordMu.RUnlock()
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	return conn.WriteJSON(rec)
+}
+
+// updateClusterStatus is the one loop that watches globalCluster for
+// changes; /ws/cluster-status subscribers are woken through
+// globalClusterStatusBroadcaster instead of each holding its own ticker.
+func updateClusterStatus(stopc <-chan struct{}) {
+	ticker := time.NewTicker(clusterStatusPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopc:
+			return
+		case <-ticker.C:
+			b, err := json.Marshal(globalCluster)
+			if err != nil {
+				glog.Warningf("failed to marshal cluster status (%v)", err)
+				continue
+			}
+			globalClusterStatusBroadcaster.notify(string(b))
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backend defines a pluggable storage backend for syncing recorded
+// etcd test data, with GCS, S3, and local filesystem implementations chosen
+// via Config rather than branching on whether a GCS key was given.
+package backend
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/coreos/etcdlabs/pkg/record/recordpb"
+)
+
+// Kind selects which storage implementation New constructs.
+type Kind string
+
+const (
+	// KindLocal stores records on the local filesystem. It is the
+	// default so a playground instance still records locally when no
+	// object-store credentials are configured.
+	KindLocal Kind = "local"
+	KindGCS   Kind = "gcs"
+	KindS3    Kind = "s3"
+)
+
+// Backend persists and retrieves recorded test data.
+type Backend interface {
+	// Name identifies the backend for logging and metrics.
+	Name() string
+	// Save persists rec under key.
+	Save(ctx context.Context, key string, rec *recordpb.Record) error
+	// Load retrieves the most recently saved record for key.
+	Load(ctx context.Context, key string) (*recordpb.Record, error)
+	// Close releases any resources held by the backend.
+	Close() error
+}
+
+// Stater is implemented by a Backend that tracks cumulative cache hit/miss
+// counts, such as the on-disk cache New wraps every backend with. Callers
+// that want to expose those counts (e.g. as a metric) should type-assert
+// the Backend returned by New against this interface.
+type Stater interface {
+	Stats() (hits, misses uint64)
+}
+
+// Config selects and configures a Backend, plus the on-disk cache New wraps
+// every backend with.
+type Config struct {
+	Kind Kind
+
+	// GCSKey is the service-account JSON key used when Kind is KindGCS.
+	GCSKey []byte
+
+	// S3Bucket and S3Region configure the object store used when Kind is
+	// KindS3.
+	S3Bucket string
+	S3Region string
+
+	// LocalDir is the directory used when Kind is KindLocal. If empty, a
+	// temporary directory is created.
+	LocalDir string
+
+	// CacheDir is where the on-disk read-through cache is kept. If empty,
+	// a temporary directory is created.
+	CacheDir string
+	// CacheMaxBytes bounds the cache size in absolute bytes. If zero,
+	// CacheMaxPercent of the cache filesystem's free space is used
+	// instead.
+	CacheMaxBytes int64
+	// CacheMaxPercent bounds the cache size as a fraction of the cache
+	// filesystem's free space, defaulting to 0.10 (10%), mirroring
+	// Arvados' WebDAV cache default.
+	CacheMaxPercent float64
+}
+
+// New constructs the Backend selected by cfg.Kind and wraps it with a
+// bounded on-disk LRU cache.
+func New(ctx context.Context, cfg Config) (Backend, error) {
+	var (
+		b   Backend
+		err error
+	)
+	switch cfg.Kind {
+	case KindGCS:
+		b, err = newGCSBackend(ctx, cfg.GCSKey)
+	case KindS3:
+		b, err = newS3Backend(cfg.S3Bucket, cfg.S3Region)
+	case KindLocal, "":
+		b, err = newLocalBackend(cfg.LocalDir)
+	default:
+		return nil, fmt.Errorf("record/backend: unknown kind %q", cfg.Kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newCache(b, cfg.CacheDir, cfg.CacheMaxBytes, cfg.CacheMaxPercent)
+}
@@ -0,0 +1,214 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"container/list"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/coreos/etcdlabs/pkg/record/recordpb"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+)
+
+// defaultCacheMaxPercent mirrors Arvados' WebDAV cache default: absent an
+// explicit byte bound, use roughly 10% of the cache filesystem's free space.
+const defaultCacheMaxPercent = 0.10
+
+// cacheEntry tracks one cached record; callers key entries as
+// "<endpoint>/<unix-nano>" so each snapshot is its own entry. evictLocked
+// drops the least recently used entries across all endpoints; it does not
+// evict per endpoint.
+type cacheEntry struct {
+	key       string
+	sizeBytes int64
+}
+
+// cache wraps a Backend with a bounded on-disk LRU read-through cache, so a
+// Load for a key this process already has on disk is served locally instead
+// of going back to the wrapped Backend every time.
+type cache struct {
+	Backend
+
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	used    int64
+	order   *list.List // front = most recently used
+	entries map[string]*list.Element
+
+	hits   uint64
+	misses uint64
+}
+
+func newCache(b Backend, dir string, maxBytes int64, maxPercent float64) (Backend, error) {
+	if dir == "" {
+		var err error
+		dir, err = ioutil.TempDir(os.TempDir(), "backend-record-cache")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	if maxBytes <= 0 {
+		if maxPercent <= 0 {
+			maxPercent = defaultCacheMaxPercent
+		}
+		free, err := freeBytes(dir)
+		if err != nil {
+			return nil, err
+		}
+		maxBytes = int64(float64(free) * maxPercent)
+	}
+
+	return &cache{
+		Backend:  b,
+		dir:      dir,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}, nil
+}
+
+func freeBytes(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// Save writes through to the wrapped Backend, then refreshes the local
+// cache copy, evicting least-recently-used entries if needed to stay under
+// maxBytes.
+func (c *cache) Save(ctx context.Context, key string, rec *recordpb.Record) error {
+	if err := c.Backend.Save(ctx, key, rec); err != nil {
+		return err
+	}
+
+	data, err := proto.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evictLocked(int64(len(data)))
+	if err := c.writeLocked(key, data); err != nil {
+		return err
+	}
+	c.touchLocked(key, int64(len(data)))
+	return nil
+}
+
+// Load serves from the on-disk cache on a hit, otherwise falls back to the
+// wrapped Backend and populates the cache for next time.
+func (c *cache) Load(ctx context.Context, key string) (*recordpb.Record, error) {
+	c.mu.Lock()
+	el, hit := c.entries[key]
+	if hit {
+		c.order.MoveToFront(el)
+		c.hits++
+	} else {
+		c.misses++
+	}
+	c.mu.Unlock()
+
+	if hit {
+		if data, err := ioutil.ReadFile(c.path(key)); err == nil {
+			rec := &recordpb.Record{}
+			if err := proto.Unmarshal(data, rec); err == nil {
+				return rec, nil
+			}
+		}
+	}
+
+	rec, err := c.Backend.Load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err := proto.Marshal(rec); err == nil {
+		c.mu.Lock()
+		c.evictLocked(int64(len(data)))
+		if err := c.writeLocked(key, data); err == nil {
+			c.touchLocked(key, int64(len(data)))
+		}
+		c.mu.Unlock()
+	}
+	return rec, nil
+}
+
+// Stats returns cumulative cache hit/miss counts.
+func (c *cache) Stats() (hits, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+func (c *cache) touchLocked(key string, size int64) {
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		c.used += size - e.sizeBytes
+		e.sizeBytes = size
+		c.order.MoveToFront(el)
+		return
+	}
+	e := &cacheEntry{key: key, sizeBytes: size}
+	c.entries[key] = c.order.PushFront(e)
+	c.used += size
+}
+
+func (c *cache) evictLocked(incoming int64) {
+	for c.used+incoming > c.maxBytes {
+		back := c.order.Back()
+		if back == nil {
+			return
+		}
+		e := back.Value.(*cacheEntry)
+		c.order.Remove(back)
+		delete(c.entries, e.key)
+		c.used -= e.sizeBytes
+		if err := os.Remove(c.path(e.key)); err != nil && !os.IsNotExist(err) {
+			glog.Warningf("failed to evict cached record %q (%v)", e.key, err)
+		}
+	}
+}
+
+// writeLocked writes data to c.path(key), creating the key's parent
+// directory first since keys such as "<endpoint>/<unix-nano>" nest under a
+// per-endpoint subdirectory that only exists once something is cached under
+// it. Callers must hold c.mu.
+func (c *cache) writeLocked(key string, data []byte) error {
+	p := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, 0600)
+}
+
+func (c *cache) path(key string) string {
+	return filepath.Join(c.dir, key+".pb")
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+
+	"github.com/coreos/etcdlabs/pkg/gcp"
+	"github.com/coreos/etcdlabs/pkg/record/recordpb"
+
+	"cloud.google.com/go/storage"
+	"github.com/golang/protobuf/proto"
+)
+
+type gcsBackend struct {
+	api *gcp.GCS
+}
+
+func newGCSBackend(ctx context.Context, key []byte) (Backend, error) {
+	api, err := gcp.NewGCS(ctx, "etcd", storage.ScopeFullControl, key, "record")
+	if err != nil {
+		return nil, err
+	}
+	return &gcsBackend{api: api}, nil
+}
+
+func (b *gcsBackend) Name() string { return string(KindGCS) }
+
+func (b *gcsBackend) Save(ctx context.Context, key string, rec *recordpb.Record) error {
+	data, err := proto.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return b.api.Write(ctx, key, data)
+}
+
+func (b *gcsBackend) Load(ctx context.Context, key string) (*recordpb.Record, error) {
+	data, err := b.api.Read(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	rec := &recordpb.Record{}
+	if err := proto.Unmarshal(data, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (b *gcsBackend) Close() error {
+	b.api.Close()
+	return nil
+}
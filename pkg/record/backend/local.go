@@ -0,0 +1,76 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/etcdlabs/pkg/record/recordpb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+type localBackend struct {
+	dir string
+}
+
+func newLocalBackend(dir string) (Backend, error) {
+	if dir == "" {
+		var err error
+		dir, err = ioutil.TempDir(os.TempDir(), "backend-record")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &localBackend{dir: dir}, nil
+}
+
+func (b *localBackend) Name() string { return string(KindLocal) }
+
+func (b *localBackend) Save(ctx context.Context, key string, rec *recordpb.Record) error {
+	data, err := proto.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	p := b.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, 0600)
+}
+
+func (b *localBackend) Load(ctx context.Context, key string) (*recordpb.Record, error) {
+	data, err := ioutil.ReadFile(b.path(key))
+	if err != nil {
+		return nil, err
+	}
+	rec := &recordpb.Record{}
+	if err := proto.Unmarshal(data, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (b *localBackend) Close() error { return nil }
+
+func (b *localBackend) path(key string) string {
+	return filepath.Join(b.dir, key+".pb")
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/coreos/etcdlabs/pkg/record/recordpb"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/protobuf/proto"
+)
+
+type s3Backend struct {
+	bucket string
+	client *s3.S3
+}
+
+func newS3Backend(bucket, region string) (Backend, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Backend{bucket: bucket, client: s3.New(sess)}, nil
+}
+
+func (b *s3Backend) Name() string { return string(KindS3) }
+
+func (b *s3Backend) Save(ctx context.Context, key string, rec *recordpb.Record) error {
+	data, err := proto.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = b.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+func (b *s3Backend) Load(ctx context.Context, key string) (*recordpb.Record, error) {
+	out, err := b.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(out.Body); err != nil {
+		return nil, err
+	}
+	rec := &recordpb.Record{}
+	if err := proto.Unmarshal(buf.Bytes(), rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (b *s3Backend) Close() error { return nil }